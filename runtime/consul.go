@@ -0,0 +1,300 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	ConsulRegisterLabel = "io.rancher.service.consul_register"
+	ConsulNameLabel     = "io.rancher.service.consul_name"
+	ConsulTagsLabel     = "io.rancher.service.consul_tags"
+	// ConsulPortLabel optionally pins the container (private) port whose
+	// published binding is registered with Consul, for containers that
+	// publish more than one port.
+	ConsulPortLabel = "io.rancher.service.consul_port"
+
+	defaultConsulAddr = "http://127.0.0.1:8500"
+	consulTimeout     = 10 * time.Second
+)
+
+var (
+	consulHTTPClient = &http.Client{Timeout: consulTimeout}
+
+	consulCheckStopMu sync.Mutex
+	consulCheckStop   = map[string]chan struct{}{}
+)
+
+// consulCheck mirrors the subset of Consul's agent check registration fields
+// that we can derive from the health config already assembled in setupHealthConfig.
+type consulCheck struct {
+	TTL                            string `json:"TTL,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+type consulServiceRegistration struct {
+	ID      string       `json:"ID"`
+	Name    string       `json:"Name"`
+	Address string       `json:"Address"`
+	Port    int          `json:"Port,omitempty"`
+	Tags    []string     `json:"Tags,omitempty"`
+	Check   *consulCheck `json:"Check,omitempty"`
+}
+
+func consulAddr() string {
+	if addr := os.Getenv("CONSUL_HTTP_ADDR"); addr != "" {
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			addr = "http://" + addr
+		}
+		return addr
+	}
+	return defaultConsulAddr
+}
+
+// registerConsulService registers a successfully-started container with the
+// Consul catalog when it carries the ConsulRegisterLabel. Registration
+// failures are non-fatal to container start and are returned for the caller
+// to log.
+func registerConsulService(runtimeClient *client.Client, containerSpec v3.Container, containerID string) error {
+	labels := containerSpec.Labels
+	if labels == nil || strings.ToLower(labels[ConsulRegisterLabel]) != "true" {
+		return nil
+	}
+
+	inspect, err := runtimeClient.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container for consul registration: %w", err)
+	}
+
+	address := ""
+	for _, network := range inspect.NetworkSettings.Networks {
+		if network.IPAddress != "" {
+			address = network.IPAddress
+			break
+		}
+	}
+
+	port := resolveConsulPort(labels[ConsulPortLabel], inspect.NetworkSettings.Ports)
+
+	name := labels[ConsulNameLabel]
+	if name == "" {
+		name = containerSpec.Name
+	}
+
+	var tags []string
+	if raw := labels[ConsulTagsLabel]; raw != "" {
+		for _, tag := range strings.Split(raw, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	registration := consulServiceRegistration{
+		ID:      consulServiceID(containerSpec),
+		Name:    name,
+		Address: address,
+		Port:    port,
+		Tags:    tags,
+	}
+
+	var checkInterval time.Duration
+	if containerSpec.HealthCmd != nil && len(containerSpec.HealthCmd) > 0 {
+		checkInterval = healthCheckInterval(containerSpec)
+		registration.Check = &consulCheck{
+			TTL:                            (checkInterval * 3).String(),
+			DeregisterCriticalServiceAfter: (checkInterval * 10).String(),
+		}
+	}
+
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return fmt.Errorf("failed to marshal consul registration: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, consulAddr()+"/v1/agent/service/register", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build consul registration request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := consulHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach consul catalog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("consul catalog register returned status %v", resp.StatusCode)
+	}
+
+	if registration.Check != nil {
+		startConsulCheckKeepalive(registration.ID, checkInterval)
+	}
+
+	logrus.Infof("rancher id [%v]: registered container [%v] with consul as service [%v]", containerSpec.Id, containerID, name)
+	return nil
+}
+
+func healthCheckInterval(containerSpec v3.Container) time.Duration {
+	interval := time.Duration(containerSpec.HealthInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return interval
+}
+
+// deregisterConsulService removes a previously-registered service from the
+// Consul catalog. It is a no-op when the container does not carry
+// ConsulRegisterLabel; a labelled container is deregistered even if its
+// registration had failed.
+// Hook this into the stop/remove event path alongside unmountRancherFlexVolume.
+func deregisterConsulService(containerSpec v3.Container) error {
+	labels := containerSpec.Labels
+	if labels == nil || strings.ToLower(labels[ConsulRegisterLabel]) != "true" {
+		return nil
+	}
+
+	serviceID := consulServiceID(containerSpec)
+	stopConsulCheckKeepalive(serviceID)
+
+	req, err := http.NewRequest(http.MethodPut, consulAddr()+"/v1/agent/service/deregister/"+serviceID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build consul deregistration request: %w", err)
+	}
+
+	resp, err := consulHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach consul catalog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("consul catalog deregister returned status %v", resp.StatusCode)
+	}
+
+	logrus.Infof("rancher id [%v]: deregistered service [%v] from consul", containerSpec.Id, serviceID)
+	return nil
+}
+
+func consulServiceID(containerSpec v3.Container) string {
+	return fmt.Sprintf("r-%s", containerSpec.Uuid)
+}
+
+// resolveConsulPort picks the published host port to register with Consul.
+// When portLabel names a container port (e.g. "8080" or "8080/tcp") with a
+// published binding, that binding wins. Otherwise the bindings are sorted by
+// container port so the result is deterministic across restarts/reconciles,
+// rather than depending on Go's randomized map iteration order.
+func resolveConsulPort(portLabel string, ports nat.PortMap) int {
+	if portLabel != "" {
+		candidate := portLabel
+		if !strings.Contains(candidate, "/") {
+			candidate += "/tcp"
+		}
+		if bindings, ok := ports[nat.Port(candidate)]; ok && len(bindings) > 0 {
+			if hostPort, err := strconv.Atoi(bindings[0].HostPort); err == nil {
+				return hostPort
+			}
+		}
+	}
+
+	containerPorts := make([]nat.Port, 0, len(ports))
+	for port := range ports {
+		containerPorts = append(containerPorts, port)
+	}
+	sort.Slice(containerPorts, func(i, j int) bool {
+		iNum, _ := containerPorts[i].Int()
+		jNum, _ := containerPorts[j].Int()
+		if iNum != jNum {
+			return iNum < jNum
+		}
+		return containerPorts[i] < containerPorts[j]
+	})
+
+	for _, port := range containerPorts {
+		bindings := ports[port]
+		if len(bindings) == 0 {
+			continue
+		}
+		if hostPort, err := strconv.Atoi(bindings[0].HostPort); err == nil {
+			return hostPort
+		}
+	}
+	return 0
+}
+
+// startConsulCheckKeepalive PUTs /v1/agent/check/pass/:check_id once per
+// interval so the TTL check registered alongside serviceID stays passing
+// until stopConsulCheckKeepalive is called for it. It does not look at the
+// container's state or health. Without it, Consul would mark the service
+// critical and deregister it after DeregisterCriticalServiceAfter.
+func startConsulCheckKeepalive(serviceID string, interval time.Duration) {
+	stop := make(chan struct{})
+
+	consulCheckStopMu.Lock()
+	if existing, ok := consulCheckStop[serviceID]; ok {
+		close(existing)
+	}
+	consulCheckStop[serviceID] = stop
+	consulCheckStopMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := passConsulCheck(serviceID); err != nil {
+					logrus.Warnf("consul: failed to pass health check for service [%v]: %v", serviceID, err)
+				}
+			}
+		}
+	}()
+}
+
+// stopConsulCheckKeepalive stops a keepalive goroutine started by
+// startConsulCheckKeepalive, if one is running for serviceID.
+func stopConsulCheckKeepalive(serviceID string) {
+	consulCheckStopMu.Lock()
+	defer consulCheckStopMu.Unlock()
+	if stop, ok := consulCheckStop[serviceID]; ok {
+		close(stop)
+		delete(consulCheckStop, serviceID)
+	}
+}
+
+func passConsulCheck(serviceID string) error {
+	checkID := "service:" + serviceID
+	req, err := http.NewRequest(http.MethodPut, consulAddr()+"/v1/agent/check/pass/"+checkID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build consul check-pass request: %w", err)
+	}
+
+	resp, err := consulHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach consul catalog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("consul check pass returned status %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -17,27 +18,37 @@ import (
 	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
-	"github.com/pkg/errors"
 	"github.com/rancher/agent/host_info"
 	"github.com/rancher/agent/progress"
+	"github.com/rancher/agent/trust"
 	"github.com/rancher/agent/utils"
 	v3 "github.com/rancher/go-rancher/v3"
 )
 
 const (
-	PullImageLabels = "io.rancher.container.pull_image"
-	nameInuseError  = "You have to remove (or rename) that container to be able to reuse that name"
+	PullImageLabels           = "io.rancher.container.pull_image"
+	ContainerRuntimeLabel     = "io.rancher.container.runtime"
+	WaitHealthyLabel          = "io.rancher.container.start.wait_healthy"
+	WaitHealthyTimeoutLabel   = "io.rancher.container.start.wait_healthy_timeout"
+	defaultWaitHealthyTimeout = 60 * time.Second
+	healthPollInterval        = time.Second
+	nameInuseError            = "You have to remove (or rename) that container to be able to reuse that name"
 )
 
 var (
-	dockerRootOnce = sync.Once{}
-	dockerRoot     = ""
-	HTTPProxyList  = []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY", "no_proxy", "NO_PROXY"}
+	dockerRootOnce     = sync.Once{}
+	dockerRoot         = ""
+	dockerRuntimesOnce = sync.Once{}
+	dockerRuntimes     = map[string]types.Runtime{}
+	HTTPProxyList      = []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY", "no_proxy", "NO_PROXY"}
 )
 
 func ContainerStart(containerSpec v3.Container, volumes []v3.Volume, networkKind string, credentials []v3.Credential, progress *progress.Progress, runtimeClient *client.Client, idsMap map[string]string) (string, error) {
 	started := false
 
+	cacheSpec(containerSpec, volumes, networkKind, credentials, idsMap)
+	ensureEventReconciler(runtimeClient, progress)
+
 	// setup name
 	parts := strings.Split(containerSpec.Uuid, "-")
 	if len(parts) == 0 {
@@ -51,7 +62,7 @@ func ContainerStart(containerSpec v3.Container, volumes []v3.Volume, networkKind
 	// creating managed volumes
 	rancherBindMounts, err := setupRancherFlexVolume(volumes, containerSpec.DataVolumes, progress)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to set up rancher flex volumes")
+		return "", fmt.Errorf("failed to set up rancher flex volumes: %w", err)
 	}
 
 	// make sure managed volumes are unmounted if container is not started
@@ -64,12 +75,12 @@ func ContainerStart(containerSpec v3.Container, volumes []v3.Volume, networkKind
 	// setup container spec(config and hostConfig)
 	spec, err := setupContainerSpec(containerSpec, volumes, networkKind, rancherBindMounts, runtimeClient, progress, idsMap)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to generate container spec")
+		return "", fmt.Errorf("failed to generate container spec: %w", err)
 	}
 
 	containerID, err := utils.FindContainer(runtimeClient, containerSpec, false)
 	if err != nil && !utils.IsContainerNotFoundError(err) {
-		return "", errors.Wrap(err, "failed to get container")
+		return "", fmt.Errorf("failed to get container: %w", err)
 	}
 	created := false
 	if containerID == "" {
@@ -81,13 +92,13 @@ func ContainerStart(containerSpec v3.Container, volumes []v3.Volume, networkKind
 			}
 		}
 		newID, err := createContainer(runtimeClient, &spec.config, &spec.hostConfig, containerSpec, credential, name, progress)
-		if err != nil && !strings.Contains(err.Error(), nameInuseError) {
-			return "", errors.Wrap(err, "failed to create container")
+		if err != nil && !errors.Is(err, ErrNameInUse) {
+			return "", fmt.Errorf("failed to create container: %w", err)
 		}
 		if newID == "" {
 			contID, err := utils.FindContainer(runtimeClient, containerSpec, true)
 			if err != nil && !utils.IsContainerNotFoundError(err) {
-				return "", errors.Wrap(err, "failed to get container")
+				return "", fmt.Errorf("failed to get container: %w", err)
 			}
 			containerID = contID
 		} else {
@@ -103,14 +114,28 @@ func ContainerStart(containerSpec v3.Container, volumes []v3.Volume, networkKind
 	if startErr != nil {
 		if created {
 			if err := utils.RemoveContainer(runtimeClient, containerID); err != nil {
-				return "", errors.Wrapf(err, "failed to remove container: failed to start: %v", startErr)
+				return "", fmt.Errorf("failed to remove container: failed to start: %v: %w", startErr, err)
 			}
 		}
-		return "", errors.Wrap(startErr, "failed to start container")
+		return "", fmt.Errorf("failed to start container: %w", startErr)
+	}
+
+	if err := waitForHealthy(runtimeClient, containerSpec, containerID); err != nil {
+		if created {
+			if removeErr := utils.RemoveContainer(runtimeClient, containerID); removeErr != nil {
+				return "", fmt.Errorf("failed to remove container: failed to wait for healthy: %v: %w", err, removeErr)
+			}
+		}
+		return "", err
 	}
 
 	logrus.Infof("rancher id [%v]: Container [%v] with docker id [%v] has been started", containerSpec.Id, containerSpec.Name, containerID)
 	started = true
+
+	if err := registerConsulService(runtimeClient, containerSpec, containerID); err != nil {
+		logrus.Errorf("rancher id [%v]: failed to register container [%v] with consul: %v", containerSpec.Id, containerID, err)
+	}
+
 	return containerID, nil
 }
 
@@ -120,7 +145,7 @@ func IsContainerStarted(containerSpec v3.Container, client *client.Client) (bool
 		if utils.IsContainerNotFoundError(err) {
 			return false, false, nil
 		}
-		return false, false, errors.Wrap(err, "failed to get container")
+		return false, false, fmt.Errorf("%v: %w", err, ErrContainerLookup)
 	}
 	return isRunning(client, cont)
 }
@@ -146,12 +171,16 @@ func setupContainerSpec(containerSpec v3.Container, volumes []v3.Volume, network
 
 	setupFieldsHostConfig(containerSpec, &hostConfig)
 
+	if err := setupOCIRuntime(containerSpec, &config, &hostConfig, runtimeClient); err != nil {
+		return dockerContainerSpec{}, fmt.Errorf("failed to set up OCI runtime: %w", err)
+	}
+
 	setupFieldsConfig(containerSpec, &config)
 
 	setupPublishPorts(&hostConfig, containerSpec)
 
 	if err := setupDNSSearch(&hostConfig, containerSpec); err != nil {
-		return dockerContainerSpec{}, errors.Wrap(err, "failed to set up DNS search")
+		return dockerContainerSpec{}, fmt.Errorf("failed to set up DNS search: %w", err)
 	}
 
 	setupHostname(&config, containerSpec)
@@ -161,11 +190,11 @@ func setupContainerSpec(containerSpec v3.Container, volumes []v3.Volume, network
 	hostConfig.Binds = append(hostConfig.Binds, rancherBindMounts...)
 
 	if err := setupNonRancherVolumes(&config, volumes, containerSpec, &hostConfig, runtimeClient, progress, idsMap); err != nil {
-		return dockerContainerSpec{}, errors.Wrap(err, "failed to set up volumes")
+		return dockerContainerSpec{}, fmt.Errorf("failed to set up volumes: %w", err)
 	}
 
 	if err := setupNetworking(containerSpec, &config, &hostConfig, idsMap, networkKind); err != nil {
-		return dockerContainerSpec{}, errors.Wrap(err, "failed to set up networking")
+		return dockerContainerSpec{}, fmt.Errorf("%v: %w", err, ErrNetworkSetup)
 	}
 
 	setupDeviceOptions(&hostConfig, containerSpec)
@@ -197,7 +226,10 @@ func createContainer(dockerClient *client.Client, config *container.Config, host
 		}
 		_, err := DoInstancePull(params, progress, dockerClient, credential)
 		if err != nil {
-			return "", errors.Wrap(err, "failed to pull instance")
+			return "", fmt.Errorf("%v: %w", err, ErrImagePull)
+		}
+		if err := verifyImageTrust(dockerClient, containerSpec.Image); err != nil {
+			return "", err
 		}
 	}
 	config.Image = containerSpec.Image
@@ -210,19 +242,49 @@ func createContainer(dockerClient *client.Client, config *container.Config, host
 	// if image doesn't exist
 	if client.IsErrImageNotFound(err) {
 		if err := ImagePull(progress, dockerClient, containerSpec.Image, credential); err != nil {
-			return "", errors.Wrap(err, "failed to pull image")
+			return "", fmt.Errorf("%v: %w", err, ErrImagePull)
+		}
+		if err := verifyImageTrust(dockerClient, containerSpec.Image); err != nil {
+			return "", err
 		}
 		containerResponse, err1 := dockerContainerCreate(context.Background(), dockerClient, config, hostConfig, name)
 		if err1 != nil {
-			return "", errors.Wrap(err1, "failed to create container")
+			return "", wrapContainerCreateErr(err1)
 		}
 		return containerResponse.ID, nil
 	} else if err != nil {
-		return "", errors.Wrap(err, "failed to create container")
+		return "", wrapContainerCreateErr(err)
 	}
 	return containerResponse.ID, nil
 }
 
+// verifyImageTrust resolves the digest(s) of a just-pulled image and gates
+// container creation behind the configured trust.Policy. The image is always
+// inspected, and an inspect failure is returned; when no trust policy is
+// enabled, trust.Verify accepts every image.
+func verifyImageTrust(dockerClient *client.Client, image string) error {
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return fmt.Errorf("failed to inspect pulled image: %w", err)
+	}
+
+	if err := trust.Verify(image, inspect.RepoDigests); err != nil {
+		return fmt.Errorf("%v: %w", err, ErrUntrustedImage)
+	}
+	return nil
+}
+
+// wrapContainerCreateErr classifies a docker container-create failure,
+// surfacing the name-in-use case (today detected by substring match on
+// docker's own error text) as ErrNameInUse so callers can rename/retry
+// instead of giving up.
+func wrapContainerCreateErr(err error) error {
+	if strings.Contains(err.Error(), nameInuseError) {
+		return fmt.Errorf("%v: %w", err, ErrNameInUse)
+	}
+	return fmt.Errorf("%v: %w", err, ErrContainerCreate)
+}
+
 func initializeMaps(config *container.Config, hostConfig *container.HostConfig) {
 	config.Labels = make(map[string]string)
 	config.Volumes = make(map[string]struct{})
@@ -281,6 +343,40 @@ func getDockerRoot(client *client.Client) string {
 	return dockerRoot
 }
 
+// getDockerRuntimes returns the OCI runtimes the daemon advertises, keyed by
+// name (e.g. "runc", "kata-runtime"), as reported by `docker info`.
+func getDockerRuntimes(client *client.Client) map[string]types.Runtime {
+	dockerRuntimesOnce.Do(func() {
+		info, err := client.Info(context.Background())
+		if err != nil {
+			panic(err.Error())
+		}
+		dockerRuntimes = info.Runtimes
+	})
+	return dockerRuntimes
+}
+
+// setupOCIRuntime selects the OCI runtime Docker will use to launch the
+// container based on the ContainerRuntimeLabel, validating it against the
+// runtimes the daemon advertises. The selected runtime is written back onto
+// the container labels so the scheduler can see what was actually used. When
+// the label is absent, the daemon's default runtime is used and no runtime
+// label is written.
+func setupOCIRuntime(containerSpec v3.Container, config *container.Config, hostConfig *container.HostConfig, runtimeClient *client.Client) error {
+	requested := containerSpec.Labels[ContainerRuntimeLabel]
+	if requested == "" {
+		return nil
+	}
+
+	if _, ok := getDockerRuntimes(runtimeClient)[requested]; !ok {
+		return fmt.Errorf("runtime %q requested via %s is not advertised by the docker daemon", requested, ContainerRuntimeLabel)
+	}
+
+	hostConfig.Runtime = requested
+	config.Labels[ContainerRuntimeLabel] = requested
+	return nil
+}
+
 // setupVolumes volumes except rancher specific volumes. For rancher-managed volume driver they will be setup through special steps like flexvolume
 func setupNonRancherVolumes(config *container.Config, volumes []v3.Volume, containerSpec v3.Container, hostConfig *container.HostConfig, client *client.Client, progress *progress.Progress, idsMap map[string]string) error {
 	volumesMap := map[string]struct{}{}
@@ -345,10 +441,10 @@ func setupNonRancherVolumes(config *container.Config, volumes []v3.Volume, conta
 		if !IsRancherVolume(volume) {
 			if ok, err := IsVolumeActive(volume, client); !ok && err == nil {
 				if err := DoVolumeActivate(volume, client, progress); err != nil {
-					return errors.Wrap(err, "failed to activate volume")
+					return fmt.Errorf("%v: %w", err, ErrVolumeActivate)
 				}
 			} else if err != nil {
-				return errors.Wrap(err, "failed to check whether volume is activated")
+				return fmt.Errorf("failed to check whether volume is activated: %w", err)
 			}
 		}
 	}
@@ -406,6 +502,39 @@ func setupFieldsConfig(spec v3.Container, config *container.Config) {
 	config.User = spec.User
 }
 
+// waitForHealthy implements an optional "wait-for-healthy" readiness gate,
+// enabled via WaitHealthyLabel, that blocks ContainerStart from returning
+// until the container's HealthConfig (assembled in setupHealthConfig)
+// reports healthy or WaitHealthyTimeoutLabel elapses.
+func waitForHealthy(runtimeClient *client.Client, containerSpec v3.Container, containerID string) error {
+	labels := containerSpec.Labels
+	if labels == nil || strings.ToLower(labels[WaitHealthyLabel]) != "true" {
+		return nil
+	}
+
+	timeout := defaultWaitHealthyTimeout
+	if raw := labels[WaitHealthyTimeoutLabel]; raw != "" {
+		if seconds, err := strconv.Atoi(raw); err == nil {
+			timeout = time.Duration(seconds) * time.Second
+		}
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		inspect, err := runtimeClient.ContainerInspect(context.Background(), containerID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container while waiting for healthy: %w", err)
+		}
+		if inspect.State.Health == nil || inspect.State.Health.Status == types.Healthy {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container [%v] did not become healthy within %v: %w", containerID, timeout, ErrHealthTimeout)
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
 func isRunning(dockerClient *client.Client, containerID string) (bool, bool, error) {
 	if containerID == "" {
 		return false, false, nil
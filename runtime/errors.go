@@ -0,0 +1,18 @@
+package runtime
+
+import "errors"
+
+// Typed error taxonomy for ContainerStart and its helpers. Callers can match
+// against these with errors.Is/As instead of string-matching docker's raw
+// error text, and react to specific failure classes (retry pull vs. rename
+// vs. give up).
+var (
+	ErrImagePull       = errors.New("image pull failed")
+	ErrVolumeActivate  = errors.New("volume activation failed")
+	ErrContainerCreate = errors.New("container create failed")
+	ErrNameInUse       = errors.New("container name already in use")
+	ErrNetworkSetup    = errors.New("network setup failed")
+	ErrHealthTimeout   = errors.New("container did not become healthy before timeout")
+	ErrUntrustedImage  = errors.New("image failed content-trust verification")
+	ErrContainerLookup = errors.New("failed to look up existing container")
+)
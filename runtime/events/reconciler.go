@@ -0,0 +1,145 @@
+// Package events subscribes to the Docker daemon's event stream and drives
+// reconciliation of containers managed by this agent when they transition
+// out-of-band (manual docker rm, OOM kill, a failed health check) instead of
+// through the top-level Rancher instruction handler. Without this, such
+// transitions leave agent state divergent until the next full sync.
+package events
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/rancher/agent/utils"
+)
+
+// DefaultDebounce is how long the reconciler waits after the last observed
+// event for a container before acting, so a flurry of die/destroy events for
+// the same container collapses into a single reconcile.
+const DefaultDebounce = 2 * time.Second
+
+// Handler reconciles a single container, identified by its Rancher UUID,
+// after it has transitioned out-of-band. action is the triggering Docker
+// event action (die, oom, destroy, or "health_status: unhealthy").
+type Handler interface {
+	Reconcile(uuid string, action string) error
+}
+
+// Event reports the outcome of a single reconcile, so progress.Progress
+// reporting (or anything else) can be attached downstream.
+type Event struct {
+	UUID   string
+	Action string
+	Err    error
+}
+
+// Reconciler watches the Docker event stream for containers carrying
+// utils.UUIDLabel and debounces reconciliation of out-of-band state changes
+// through a Handler.
+type Reconciler struct {
+	dockerClient *client.Client
+	handler      Handler
+	debounce     time.Duration
+	events       chan Event
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// NewReconciler builds a Reconciler. Call Run to start consuming events; it
+// blocks until ctx is cancelled or the event stream ends unrecoverably.
+func NewReconciler(dockerClient *client.Client, handler Handler, debounce time.Duration) *Reconciler {
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	return &Reconciler{
+		dockerClient: dockerClient,
+		handler:      handler,
+		debounce:     debounce,
+		events:       make(chan Event, 100),
+		pending:      map[string]*time.Timer{},
+	}
+}
+
+// Events exposes reconcile outcomes for callers that want to attach
+// progress/metrics reporting.
+func (r *Reconciler) Events() <-chan Event {
+	return r.events
+}
+
+// Run subscribes to the Docker event stream and reconciles managed
+// containers as die/oom/health_status/destroy events arrive. It returns when
+// ctx is cancelled or the event stream errors out.
+func (r *Reconciler) Run(ctx context.Context) error {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("type", "container")
+	filterArgs.Add("event", "die")
+	filterArgs.Add("event", "oom")
+	filterArgs.Add("event", "destroy")
+	filterArgs.Add("event", "health_status")
+
+	messages, errs := r.dockerClient.Events(ctx, types.EventsOptions{Filters: filterArgs})
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+		case msg := <-messages:
+			r.handleMessage(msg)
+		}
+	}
+}
+
+func (r *Reconciler) handleMessage(msg types.Message) {
+	uuid := msg.Actor.Attributes[utils.UUIDLabel]
+	if uuid == "" {
+		// not a container managed by this agent
+		return
+	}
+
+	action := msg.Action
+	if action == "health_status: healthy" {
+		// fires on every successful check for restart-policy'd containers;
+		// only an unhealthy transition warrants reconciliation.
+		return
+	}
+	if action != "die" && action != "oom" && action != "destroy" && !strings.HasPrefix(action, "health_status") {
+		return
+	}
+
+	r.scheduleReconcile(uuid, action)
+}
+
+func (r *Reconciler) scheduleReconcile(uuid, action string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if timer, ok := r.pending[uuid]; ok {
+		timer.Stop()
+	}
+
+	r.pending[uuid] = time.AfterFunc(r.debounce, func() {
+		r.mu.Lock()
+		delete(r.pending, uuid)
+		r.mu.Unlock()
+
+		err := r.handler.Reconcile(uuid, action)
+		if err != nil {
+			logrus.Errorf("events: failed to reconcile container [%v] after [%v]: %v", uuid, action, err)
+		}
+
+		select {
+		case r.events <- Event{UUID: uuid, Action: action, Err: err}:
+		default:
+			logrus.Warnf("events: reconcile event channel full, dropping event for container [%v]", uuid)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package runtime
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/client"
+	"github.com/rancher/agent/progress"
+	"github.com/rancher/agent/runtime/events"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+// SpecLookup resolves the full desired state for a container UUID so the
+// reconciler can re-invoke ContainerStart; ok is false when no spec is known
+// for uuid. ensureEventReconciler supplies lookupCachedSpec, which answers
+// from the specs ContainerStart has been called with in this process.
+type SpecLookup func(uuid string) (containerSpec v3.Container, volumes []v3.Volume, networkKind string, credentials []v3.Credential, idsMap map[string]string, ok bool)
+
+// ReconcileHandler implements events.Handler, re-syncing a container against
+// its desired Rancher state after it transitions out-of-band.
+type ReconcileHandler struct {
+	runtimeClient *client.Client
+	lookup        SpecLookup
+	progress      *progress.Progress
+}
+
+// NewReconcileHandler builds a ReconcileHandler for use with
+// runtime/events.Reconciler.
+func NewReconcileHandler(runtimeClient *client.Client, lookup SpecLookup, progress *progress.Progress) *ReconcileHandler {
+	return &ReconcileHandler{
+		runtimeClient: runtimeClient,
+		lookup:        lookup,
+		progress:      progress,
+	}
+}
+
+// Reconcile re-syncs the container identified by uuid after action (die,
+// oom, destroy, or "health_status: unhealthy") was observed out-of-band. On
+// destroy it unmounts the container's flex volumes and deregisters it from
+// Consul, without restarting it. On die/oom/unhealthy it restarts the
+// container when its restart policy allows it.
+func (h *ReconcileHandler) Reconcile(uuid string, action string) error {
+	containerSpec, volumes, networkKind, credentials, idsMap, ok := h.lookup(uuid)
+	if !ok {
+		logrus.Debugf("events: no cached spec for container [%v], skipping reconcile", uuid)
+		return nil
+	}
+
+	if action == "destroy" {
+		unmountRancherFlexVolume(volumes)
+		if err := deregisterConsulService(containerSpec); err != nil {
+			logrus.Errorf("events: failed to deregister container [%v] from consul: %v", uuid, err)
+		}
+		return nil
+	}
+
+	if action == "health_status: healthy" {
+		// a passing health check, not a transition that warrants a restart
+		return nil
+	}
+
+	if !restartPolicyAllowsRestart(containerSpec) {
+		logrus.Infof("events: container [%v] transitioned via [%v] but restart policy [%v] does not allow a restart", uuid, action, containerSpec.RestartPolicy.Name)
+		return nil
+	}
+
+	_, err := ContainerStart(containerSpec, volumes, networkKind, credentials, h.progress, h.runtimeClient, idsMap)
+	return err
+}
+
+func restartPolicyAllowsRestart(containerSpec v3.Container) bool {
+	switch containerSpec.RestartPolicy.Name {
+	case "always", "unless-stopped", "on-failure":
+		return true
+	default:
+		return false
+	}
+}
+
+// cachedSpec is the SpecLookup-shaped state ContainerStart last saw for a
+// given container UUID.
+type cachedSpec struct {
+	containerSpec v3.Container
+	volumes       []v3.Volume
+	networkKind   string
+	credentials   []v3.Credential
+	idsMap        map[string]string
+}
+
+var (
+	specCacheMu        sync.Mutex
+	specCache          = map[string]cachedSpec{}
+	eventReconcileOnce sync.Once
+)
+
+// cacheSpec records the desired state ContainerStart was asked to apply for
+// containerSpec.Uuid, so the event reconciler (which only learns a UUID and
+// an out-of-band action from the Docker event stream) can look the rest of
+// it back up.
+func cacheSpec(containerSpec v3.Container, volumes []v3.Volume, networkKind string, credentials []v3.Credential, idsMap map[string]string) {
+	specCacheMu.Lock()
+	defer specCacheMu.Unlock()
+	specCache[containerSpec.Uuid] = cachedSpec{
+		containerSpec: containerSpec,
+		volumes:       volumes,
+		networkKind:   networkKind,
+		credentials:   credentials,
+		idsMap:        idsMap,
+	}
+}
+
+// lookupCachedSpec implements SpecLookup against the cache cacheSpec fills.
+// Entries are never removed, so ok is false only for a uuid ContainerStart
+// has not been called with in this process.
+func lookupCachedSpec(uuid string) (v3.Container, []v3.Volume, string, []v3.Credential, map[string]string, bool) {
+	specCacheMu.Lock()
+	defer specCacheMu.Unlock()
+	cached, ok := specCache[uuid]
+	if !ok {
+		return v3.Container{}, nil, "", nil, nil, false
+	}
+	return cached.containerSpec, cached.volumes, cached.networkKind, cached.credentials, cached.idsMap, true
+}
+
+// ensureEventReconciler lazily starts the runtime/events subsystem the first
+// time ContainerStart is called, wiring it to the spec cache ContainerStart
+// maintains for out-of-band die/oom/destroy/health_status reconciliation. It
+// starts the reconciler at most once per agent process.
+func ensureEventReconciler(runtimeClient *client.Client, prog *progress.Progress) {
+	eventReconcileOnce.Do(func() {
+		handler := NewReconcileHandler(runtimeClient, lookupCachedSpec, prog)
+		reconciler := events.NewReconciler(runtimeClient, handler, events.DefaultDebounce)
+		go func() {
+			if err := reconciler.Run(context.Background()); err != nil {
+				logrus.Errorf("events: reconciler stopped: %v", err)
+			}
+		}()
+	})
+}
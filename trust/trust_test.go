@@ -0,0 +1,125 @@
+package trust
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newNotaryServer(t *testing.T, priv ed25519.PrivateKey, keyID, digest, image string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig := ed25519.Sign(priv, signedPayload(image, digest))
+		json.NewEncoder(w).Encode(signatureResponse{
+			Digest:    digest,
+			KeyID:     keyID,
+			Signature: base64.StdEncoding.EncodeToString(sig),
+		})
+	}))
+}
+
+func TestVerifyAcceptsValidSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const image = "example.com/app"
+	const digest = "sha256:abc123"
+	server := newNotaryServer(t, priv, "key-1", digest, image)
+	defer server.Close()
+
+	if err := Configure(Policy{
+		Enabled:      true,
+		NotaryServer: server.URL,
+		AcceptedKeys: map[string]string{"key-1": base64.StdEncoding.EncodeToString(pub)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(image, []string{image + "@" + digest}); err != nil {
+		t.Fatalf("expected signature to verify, got: %v", err)
+	}
+}
+
+func TestVerifyRejectsUnacceptedKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const image = "example.com/app"
+	const digest = "sha256:abc123"
+	server := newNotaryServer(t, priv, "untrusted-key", digest, image)
+	defer server.Close()
+
+	if err := Configure(Policy{
+		Enabled:      true,
+		NotaryServer: server.URL,
+		AcceptedKeys: map[string]string{"key-1": base64.StdEncoding.EncodeToString(pub)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(image, []string{image + "@" + digest}); err == nil {
+		t.Fatal("expected verification to fail for a key outside the accepted set")
+	}
+}
+
+func TestVerifyUsesDigestNotWholeRepoDigest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const image = "example.com/app"
+	const digest = "sha256:abc123"
+	server := newNotaryServer(t, priv, "key-1", digest, image)
+	defer server.Close()
+
+	if err := Configure(Policy{
+		Enabled:      true,
+		NotaryServer: server.URL,
+		AcceptedKeys: map[string]string{"key-1": base64.StdEncoding.EncodeToString(pub)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// RepoDigests entries are always "name@digest", never a bare digest.
+	// Passing that whole entry through unparsed would build the wrong
+	// notary URL and sign/verify over the wrong payload.
+	if err := Verify(image, []string{image + "@" + digest}); err != nil {
+		t.Fatalf("expected signature to verify against the parsed digest, got: %v", err)
+	}
+}
+
+func TestVerifyExemptRegistrySkipsNotary(t *testing.T) {
+	if err := Configure(Policy{
+		Enabled:          true,
+		NotaryServer:     "http://127.0.0.1:1", // unreachable; must not be contacted
+		ExemptRegistries: []string{"internal.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify("internal.example.com/app", []string{"internal.example.com/app@sha256:abc123"}); err != nil {
+		t.Fatalf("expected exempt registry to skip verification, got: %v", err)
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	digest, err := parseDigest("example.com/app@sha256:abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:abc123" {
+		t.Fatalf("expected digest %q, got %q", "sha256:abc123", digest)
+	}
+
+	if _, err := parseDigest("sha256:abc123"); err == nil {
+		t.Fatal("expected an error for a repo digest missing the name@ prefix")
+	}
+}